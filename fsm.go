@@ -0,0 +1,293 @@
+// Package fsm implements a small finite state machine library. A Ruleset
+// describes which transitions between states are legal and which guards
+// must pass before a transition is allowed; a Machine binds a Ruleset to a
+// concrete Stater and performs transitions against it.
+package fsm
+
+import (
+	"context"
+	"errors"
+)
+
+// State is the name of a state a Stater can be in.
+type State string
+
+// Stater is implemented by anything that can report and update its current
+// state. Implementations are responsible for choosing their own zero/default
+// state.
+type Stater interface {
+	CurrentState() State
+	SetState(State)
+}
+
+// T identifies a transition from state O ("origin") to state E ("exit").
+type T struct {
+	O, E State
+}
+
+// InvalidTransition is returned whenever a transition isn't present in the
+// Ruleset at all, i.e. it was never declared via AddTransition.
+var InvalidTransition = errors.New("fsm: invalid transition")
+
+// GuardFunc is the original guard signature: given the subject attempting a
+// transition and the goal state, it returns a non-nil error to veto the
+// transition. It is kept around so existing callers don't have to change,
+// and is adapted into a ContextGuardFunc internally.
+type GuardFunc func(subject Stater, goal State) error
+
+// ContextGuardFunc is a guard that additionally receives a context. Guards
+// that select on ctx.Done() can abandon their work as soon as a sibling
+// guard has already failed the transition, instead of running to completion
+// unnoticed.
+type ContextGuardFunc func(ctx context.Context, subject Stater, goal State) error
+
+// Ruleset maps a transition to the guards that must all pass for that
+// transition to be Permitted. A transition with no guards is permitted
+// unconditionally; a transition absent from the Ruleset is InvalidTransition.
+type Ruleset map[T][]ContextGuardFunc
+
+// CreateRuleset builds a Ruleset that permits exactly the given transitions,
+// with no guards attached to any of them.
+func CreateRuleset(transitions ...T) Ruleset {
+	rules := Ruleset{}
+	for _, t := range transitions {
+		rules.AddTransition(t)
+	}
+	return rules
+}
+
+// AddTransition declares t as legal, with no guards. Calling it again on a
+// transition that already has guards leaves those guards in place.
+func (r Ruleset) AddTransition(t T) {
+	if _, ok := r[t]; !ok {
+		r[t] = []ContextGuardFunc{}
+	}
+}
+
+// AddRule attaches a legacy guard to t. The guard is wrapped so it runs
+// alongside context-aware guards; since it doesn't accept a context itself,
+// it won't observe cancellation when a sibling guard fails first.
+func (r Ruleset) AddRule(t T, rule GuardFunc) {
+	r.AddRuleContext(t, func(_ context.Context, subject Stater, goal State) error {
+		return rule(subject, goal)
+	})
+}
+
+// AddRuleContext attaches a context-aware guard to t.
+func (r Ruleset) AddRuleContext(t T, rule ContextGuardFunc) {
+	r[t] = append(r[t], rule)
+}
+
+// Permitted reports whether subject may transition to goal: the transition
+// must be declared, and every guard attached to it must pass. Guards run in
+// parallel; the first error short-circuits the rest.
+func (r Ruleset) Permitted(subject Stater, goal State) error {
+	return r.PermittedContext(context.Background(), subject, goal)
+}
+
+// PermittedContext is Permitted with an explicit context. When a guard fails
+// first, ctx is canceled for the remaining guards, so any of them blocked on
+// ctx.Done() can return promptly instead of running to completion.
+func (r Ruleset) PermittedContext(ctx context.Context, subject Stater, goal State) error {
+	return r.permittedContext(ctx, subject, goal, 0)
+}
+
+// PermittedContextConcurrent is PermittedContext with an explicit guard
+// concurrency: at most concurrency guards run at once, with the rest
+// queuing for a free slot. Every guard still gets its own goroutine; only
+// the number running a guard at once is capped. A concurrency of 0 (or one
+// that is not smaller than the number of guards attached to the transition)
+// runs every guard at once, matching PermittedContext.
+func (r Ruleset) PermittedContextConcurrent(ctx context.Context, subject Stater, goal State, concurrency int) error {
+	return r.permittedContext(ctx, subject, goal, concurrency)
+}
+
+// permittedContext is the shared implementation behind PermittedContext. A
+// concurrency of 0 (or one that is not smaller than the number of guards)
+// fans every guard out to its own goroutine, matching the historical
+// behavior; a positive, smaller concurrency caps how many guards run at
+// once, queuing the rest.
+func (r Ruleset) permittedContext(ctx context.Context, subject Stater, goal State, concurrency int) error {
+	t := T{O: subject.CurrentState(), E: goal}
+
+	rules, ok := r[t]
+	if !ok {
+		return InvalidTransition
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var sem chan struct{}
+	if concurrency > 0 && concurrency < len(rules) {
+		sem = make(chan struct{}, concurrency)
+	}
+
+	errs := make(chan error, len(rules))
+	for _, rule := range rules {
+		go func(rule ContextGuardFunc) {
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+			errs <- rule(ctx, subject, goal)
+		}(rule)
+	}
+
+	for i := 0; i < len(rules); i++ {
+		if err := <-errs; err != nil {
+			cancel()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Option configures a Machine at construction time.
+type Option func(*Machine)
+
+// WithRules sets the Ruleset a Machine consults to decide whether a
+// transition is permitted.
+func WithRules(r Ruleset) Option {
+	return func(m *Machine) { m.Rules = r }
+}
+
+// WithSubject sets the Stater a Machine transitions.
+func WithSubject(s Stater) Option {
+	return func(m *Machine) { m.Subject = s }
+}
+
+// WithGuardConcurrency caps how many of a transition's guards a Machine
+// runs at once; see PermittedContextConcurrent. A concurrency of 0 (the
+// default) leaves guard fan-out unbounded.
+func WithGuardConcurrency(n int) Option {
+	return func(m *Machine) { m.GuardConcurrency = n }
+}
+
+// Machine binds a Ruleset to a Subject and drives transitions against it.
+type Machine struct {
+	Rules            Ruleset
+	Subject          Stater
+	Limiter          TransitionLimiter
+	GuardConcurrency int
+	Observers        []Observer
+
+	Store   Store
+	StoreID string
+
+	storeVersion uint64
+	storeLoaded  bool
+}
+
+// New builds a Machine from the given Options. If both WithStore and
+// WithSubject were given, the Subject's state is loaded from the Store
+// immediately, per Store's contract, rather than on the first transition --
+// so two Machines constructed for the same id race on a stable snapshot
+// instead of one observing the other's already-committed state. A failed
+// initial load isn't fatal and its error is not kept: the first Transition
+// retries the load, the same way it reloads after an ErrStaleState, and
+// returns an error only if that load fails too.
+func New(options ...Option) *Machine {
+	m := &Machine{}
+	for _, option := range options {
+		option(m)
+	}
+
+	if m.Store != nil && m.Subject != nil {
+		m.loadFromStore()
+	}
+
+	return m
+}
+
+// loadFromStore replaces the Subject's state with whatever the Store has on
+// record for StoreID, and resets the version a subsequent CommitTransition
+// must present.
+func (m *Machine) loadFromStore() error {
+	state, version, err := m.Store.Load(m.StoreID)
+	if err != nil {
+		return err
+	}
+
+	m.Subject.SetState(state)
+	m.storeVersion = version
+	m.storeLoaded = true
+
+	return nil
+}
+
+// Transition moves the Machine's Subject to goal, or returns the error that
+// prevented it.
+func (m *Machine) Transition(goal State) error {
+	return m.TransitionContext(context.Background(), goal)
+}
+
+// TransitionContext is Transition with an explicit context, propagated to
+// PermittedContext so guards can observe cancellation and deadlines.
+func (m *Machine) TransitionContext(ctx context.Context, goal State) error {
+	// Not loaded yet (Subject wasn't set when New ran, or the initial load
+	// in New failed), or a previous CommitTransition came back stale and
+	// left us to re-sync: reload before attempting, rather than racing on
+	// outdated state forever.
+	if m.Store != nil && !m.storeLoaded {
+		from := m.Subject.CurrentState()
+		if err := m.loadFromStore(); err != nil {
+			m.notify(func(o Observer) { o.OnAttempt(from, goal) })
+			m.notify(func(o Observer) { o.OnDenied(from, goal, err) })
+			return err
+		}
+	}
+
+	from := m.Subject.CurrentState()
+
+	m.notify(func(o Observer) { o.OnAttempt(from, goal) })
+
+	if err := m.Rules.PermittedContextConcurrent(ctx, m.Subject, goal, m.GuardConcurrency); err != nil {
+		m.notify(func(o Observer) { o.OnDenied(from, goal, err) })
+		return err
+	}
+
+	if m.Limiter != nil {
+		if err := m.Limiter.Allow(ctx, from, goal); err != nil {
+			m.notify(func(o Observer) { o.OnDenied(from, goal, err) })
+			return err
+		}
+	}
+
+	if m.Store != nil {
+		if err := m.Store.CommitTransition(m.StoreID, from, goal, m.storeVersion); err != nil {
+			if err == ErrStaleState {
+				// Someone else moved this id on since we last loaded it;
+				// resync from the Store on the next attempt instead of
+				// retrying forever against the same stale (from, version).
+				m.storeLoaded = false
+			}
+			m.notify(func(o Observer) { o.OnDenied(from, goal, err) })
+			return err
+		}
+		m.storeVersion++
+	}
+
+	m.Subject.SetState(goal)
+
+	m.notify(func(o Observer) { o.OnCommitted(from, goal) })
+
+	return nil
+}
+
+// notify calls fn for every registered Observer, in order, from the calling
+// goroutine -- never from inside a guard.
+func (m *Machine) notify(fn func(Observer)) {
+	for _, o := range m.Observers {
+		fn(o)
+	}
+}
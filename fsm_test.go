@@ -1,13 +1,17 @@
 package fsm_test
 
 import (
+	"context"
 	"errors"
 	"log"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/armor5games/fsm"
 	"github.com/nbio/st"
+	"golang.org/x/time/rate"
 )
 
 // Thing is a minimal struct that is an fsm.Stater
@@ -67,6 +71,72 @@ func TestRulesetParallelGuarding(t *testing.T) {
 	st.Expect(t, rules.Permitted(&Thing{State: "started"}, "finished"), errors.New("some error"))
 }
 
+func TestRulesetParallelGuardingContextCancellation(t *testing.T) {
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "started", E: "finished"})
+
+	// A context-aware guard blocked on ctx.Done() should return as soon as
+	// the sibling guard below fails and cancels it, rather than sleeping
+	// out its full second.
+	rules.AddRuleContext(fsm.T{O: "started", E: "finished"}, func(ctx context.Context, subject fsm.Stater, goal fsm.State) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+			t.Error("Slow rule should have been cancelled")
+			return errors.New("some error")
+		}
+	})
+
+	rules.AddRuleContext(fsm.T{O: "started", E: "finished"}, func(ctx context.Context, subject fsm.Stater, goal fsm.State) error {
+		return errors.New("fast failure")
+	})
+
+	start := time.Now()
+	err := rules.Permitted(&Thing{State: "started"}, "finished")
+	elapsed := time.Since(start)
+
+	st.Expect(t, err, errors.New("fast failure"))
+
+	if elapsed >= 1*time.Second {
+		t.Errorf("expected the slow guard to be cancelled, took %s", elapsed)
+	}
+}
+
+func TestRulesetPermittedContextConcurrentCapsInFlightGuards(t *testing.T) {
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "started", E: "finished"})
+
+	const guardCount = 10
+	const concurrency = 3
+
+	var running, peak int32
+
+	for i := 0; i < guardCount; i++ {
+		rules.AddRuleContext(fsm.T{O: "started", E: "finished"}, func(ctx context.Context, subject fsm.Stater, goal fsm.State) error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+
+			atomic.AddInt32(&running, -1)
+			return nil
+		})
+	}
+
+	err := rules.PermittedContextConcurrent(context.Background(), &Thing{State: "started"}, "finished", concurrency)
+	st.Expect(t, err, nil)
+
+	if peak > concurrency {
+		t.Errorf("expected at most %d guards in flight, saw %d", concurrency, peak)
+	}
+}
+
 func TestMachineTransition(t *testing.T) {
 	rules := fsm.Ruleset{}
 	rules.AddTransition(fsm.T{O: "pending", E: "started"})
@@ -93,6 +163,162 @@ func TestMachineTransition(t *testing.T) {
 	st.Expect(t, some_thing.State, fsm.State("started"))
 }
 
+func TestMachineStoreOptimisticConcurrency(t *testing.T) {
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "pending", E: "started"})
+
+	store := fsm.NewMemoryStore()
+	store.Seed("subject-1", "pending")
+
+	machineA := fsm.New(fsm.WithRules(rules), fsm.WithSubject(&Thing{}), fsm.WithStore(store, "subject-1"))
+	machineB := fsm.New(fsm.WithRules(rules), fsm.WithSubject(&Thing{}), fsm.WithStore(store, "subject-1"))
+
+	errs := make([]error, 2)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); errs[0] = machineA.Transition("started") }()
+	go func() { defer wg.Done(); errs[1] = machineB.Transition("started") }()
+	wg.Wait()
+
+	var successes, staleErrs int
+	for _, err := range errs {
+		switch err {
+		case nil:
+			successes++
+		case fsm.ErrStaleState:
+			staleErrs++
+		}
+	}
+
+	st.Expect(t, successes, 1)
+	st.Expect(t, staleErrs, 1)
+
+	state, version, err := store.Load("subject-1")
+	st.Expect(t, err, nil)
+	st.Expect(t, state, fsm.State("started"))
+	st.Expect(t, version, uint64(1))
+}
+
+func TestMachineStoreRetryAfterStaleState(t *testing.T) {
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "pending", E: "started"})
+	rules.AddTransition(fsm.T{O: "started", E: "finished"})
+
+	store := fsm.NewMemoryStore()
+	store.Seed("subject-1", "pending")
+
+	loser := fsm.New(fsm.WithRules(rules), fsm.WithSubject(&Thing{}), fsm.WithStore(store, "subject-1"))
+
+	// Someone else moves the subject on behind loser's back.
+	winner := fsm.New(fsm.WithRules(rules), fsm.WithSubject(&Thing{}), fsm.WithStore(store, "subject-1"))
+	st.Expect(t, winner.Transition("started"), nil)
+
+	// loser still thinks the subject is "pending" at version 0, so this is
+	// exactly the stale-CAS case.
+	st.Expect(t, loser.Transition("started"), fsm.ErrStaleState)
+
+	// Without a fix, loser would be wedged forever on the same stale
+	// (from, version) pair. It should instead resync from the Store and
+	// succeed on the next attempt.
+	st.Expect(t, loser.Transition("finished"), nil)
+
+	state, _, err := store.Load("subject-1")
+	st.Expect(t, err, nil)
+	st.Expect(t, state, fsm.State("finished"))
+}
+
+// flakyStore fails its first N Load calls, then delegates to the embedded
+// Store for every call after that.
+type flakyStore struct {
+	*fsm.MemoryStore
+	failures int
+}
+
+func (s *flakyStore) Load(id string) (fsm.State, uint64, error) {
+	if s.failures > 0 {
+		s.failures--
+		return "", 0, errors.New("store unavailable")
+	}
+	return s.MemoryStore.Load(id)
+}
+
+func TestMachineStoreRetryAfterFailedInitialLoad(t *testing.T) {
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "pending", E: "started"})
+
+	inner := fsm.NewMemoryStore()
+	inner.Seed("subject-1", "pending")
+	store := &flakyStore{MemoryStore: inner, failures: 1}
+
+	// The Store fails during New's construction-time load.
+	the_machine := fsm.New(fsm.WithRules(rules), fsm.WithSubject(&Thing{}), fsm.WithStore(store, "subject-1"))
+
+	// Without a fix, the machine would be permanently wedged on the
+	// construction-time error. It should instead retry the load and
+	// succeed now that the Store has recovered.
+	st.Expect(t, the_machine.Transition("started"), nil)
+
+	state, _, err := store.Load("subject-1")
+	st.Expect(t, err, nil)
+	st.Expect(t, state, fsm.State("started"))
+}
+
+func TestMachineObserverHistory(t *testing.T) {
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "pending", E: "started"})
+	rules.AddTransition(fsm.T{O: "started", E: "finished"})
+
+	recorder := fsm.NewHistoryRecorder(10)
+
+	some_thing := Thing{State: "pending"}
+	the_machine := fsm.New(fsm.WithRules(rules), fsm.WithSubject(&some_thing), fsm.WithObserver(recorder))
+
+	// invalid: finished isn't reachable from pending
+	the_machine.Transition("finished")
+	// valid
+	the_machine.Transition("started")
+	// valid
+	the_machine.Transition("finished")
+
+	history := recorder.History()
+	if len(history) != 3 {
+		t.Fatalf("expected 3 recorded transitions, got %d", len(history))
+	}
+
+	st.Expect(t, history[0].From, fsm.State("pending"))
+	st.Expect(t, history[0].To, fsm.State("finished"))
+	st.Expect(t, history[0].Err, fsm.InvalidTransition)
+
+	st.Expect(t, history[1].From, fsm.State("pending"))
+	st.Expect(t, history[1].To, fsm.State("started"))
+	st.Expect(t, history[1].Err, nil)
+
+	st.Expect(t, history[2].From, fsm.State("started"))
+	st.Expect(t, history[2].To, fsm.State("finished"))
+	st.Expect(t, history[2].Err, nil)
+}
+
+func TestMachineTransitionRateLimited(t *testing.T) {
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "pending", E: "started"})
+
+	// A burst of one, with no refill, allows exactly one transition.
+	limiter := fsm.NewRateLimiter(rate.Limit(0), 1)
+
+	some_thing := Thing{State: "pending"}
+	the_machine := fsm.New(fsm.WithRules(rules), fsm.WithSubject(&some_thing), fsm.WithLimiter(limiter))
+
+	st.Expect(t, the_machine.Transition("started"), nil)
+	st.Expect(t, some_thing.State, fsm.State("started"))
+
+	// Permitted again (the rule still allows pending -> started), but the
+	// limiter's single token is already spent.
+	some_thing.State = "pending"
+	st.Expect(t, the_machine.Transition("started"), fsm.ErrRateLimited)
+	st.Expect(t, some_thing.State, fsm.State("pending"))
+}
+
 func BenchmarkRulesetParallelGuarding(b *testing.B) {
 	rules := fsm.Ruleset{}
 	rules.AddTransition(fsm.T{O: "pending", E: "started"})
@@ -120,6 +346,93 @@ func BenchmarkRulesetParallelGuarding(b *testing.B) {
 	}
 }
 
+func BenchmarkRulesetPermittedGuardConcurrency(b *testing.B) {
+	// Compares the peak number of guards in flight at once for an unbounded
+	// fan-out against one capped with PermittedContextConcurrent, for a
+	// transition with many guards that all overlap briefly. The peak is
+	// tracked with an atomic counter from inside the guards themselves,
+	// since b.N calls run sequentially and block until every guard for that
+	// call has returned.
+	const guardCount = 100
+
+	newRules := func(peak *int32) fsm.Ruleset {
+		var running int32
+
+		rules := fsm.Ruleset{}
+		rules.AddTransition(fsm.T{O: "started", E: "finished"})
+		for i := 0; i < guardCount; i++ {
+			rules.AddRuleContext(fsm.T{O: "started", E: "finished"}, func(ctx context.Context, subject fsm.Stater, goal fsm.State) error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					p := atomic.LoadInt32(peak)
+					if n <= p || atomic.CompareAndSwapInt32(peak, p, n) {
+						break
+					}
+				}
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}
+		return rules
+	}
+
+	b.Run("Unbounded", func(b *testing.B) {
+		var peak int32
+		rules := newRules(&peak)
+		some_thing := &Thing{State: "started"}
+
+		for i := 0; i < b.N; i++ {
+			if err := rules.Permitted(some_thing, "finished"); err != nil {
+				log.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(peak), "peak-guards-in-flight")
+	})
+
+	b.Run("BoundedConcurrency8", func(b *testing.B) {
+		var peak int32
+		rules := newRules(&peak)
+		some_thing := &Thing{State: "started"}
+
+		for i := 0; i < b.N; i++ {
+			if err := rules.PermittedContextConcurrent(context.Background(), some_thing, "finished", 8); err != nil {
+				log.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(peak), "peak-guards-in-flight")
+	})
+}
+
+func BenchmarkMachineTransitionWithLimiter(b *testing.B) {
+	// Measures the overhead a TransitionLimiter adds on top of an otherwise
+	// unconstrained transition, using a limit high enough that Allow always
+	// succeeds.
+	rules := fsm.Ruleset{}
+	rules.AddTransition(fsm.T{O: "started", E: "finished"})
+	rules.AddTransition(fsm.T{O: "finished", E: "started"})
+
+	limiter := fsm.NewEdgeRateLimiter(rate.Inf, 0)
+
+	some_thing := &Thing{State: "started"}
+	the_machine := fsm.New(fsm.WithRules(rules), fsm.WithSubject(some_thing), fsm.WithLimiter(limiter))
+
+	b.ResetTimer()
+
+	var err error
+
+	for i := 0; i < b.N; i++ {
+		goal := fsm.State("finished")
+		if some_thing.State == "finished" {
+			goal = "started"
+		}
+
+		err = the_machine.Transition(goal)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkRulesetTransitionPermitted(b *testing.B) {
 	// Permitted a transaction requires the transition to be valid and all of its
 	// guards to pass. Since we have to run every guard and there won't be any
@@ -0,0 +1,84 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned by TransitionContext when a transition is
+// otherwise Permitted but a TransitionLimiter denies it.
+var ErrRateLimited = errors.New("fsm: rate limited")
+
+// TransitionLimiter decides whether a transition from one state to another
+// may proceed right now. It is consulted after Permitted succeeds and
+// before the Subject's state is changed, so it never needs to know about
+// guards.
+type TransitionLimiter interface {
+	Allow(ctx context.Context, from, to State) error
+}
+
+// WithLimiter sets the TransitionLimiter a Machine consults before
+// committing a transition.
+func WithLimiter(l TransitionLimiter) Option {
+	return func(m *Machine) { m.Limiter = l }
+}
+
+// RateLimiter adapts a single golang.org/x/time/rate.Limiter into a
+// TransitionLimiter, applying the same limit to every edge.
+type RateLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewRateLimiter builds a RateLimiter allowing r transitions per second,
+// with bursts of up to burst.
+func NewRateLimiter(r rate.Limit, burst int) *RateLimiter {
+	return &RateLimiter{limiter: rate.NewLimiter(r, burst)}
+}
+
+// Allow implements TransitionLimiter.
+func (l *RateLimiter) Allow(ctx context.Context, from, to State) error {
+	if !l.limiter.Allow() {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// EdgeRateLimiter is a TransitionLimiter that tracks a separate token
+// bucket per T edge, so a burst on one transition can't starve another.
+type EdgeRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[T]*rate.Limiter
+	r        rate.Limit
+	burst    int
+}
+
+// NewEdgeRateLimiter builds an EdgeRateLimiter whose per-edge limiters each
+// allow r transitions per second, with bursts of up to burst.
+func NewEdgeRateLimiter(r rate.Limit, burst int) *EdgeRateLimiter {
+	return &EdgeRateLimiter{
+		limiters: make(map[T]*rate.Limiter),
+		r:        r,
+		burst:    burst,
+	}
+}
+
+// Allow implements TransitionLimiter.
+func (l *EdgeRateLimiter) Allow(ctx context.Context, from, to State) error {
+	t := T{O: from, E: to}
+
+	l.mu.Lock()
+	lim, ok := l.limiters[t]
+	if !ok {
+		lim = rate.NewLimiter(l.r, l.burst)
+		l.limiters[t] = lim
+	}
+	l.mu.Unlock()
+
+	if !lim.Allow() {
+		return ErrRateLimited
+	}
+	return nil
+}
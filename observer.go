@@ -0,0 +1,91 @@
+package fsm
+
+import (
+	"sync"
+	"time"
+)
+
+// Observer is notified around every transition a Machine attempts, whether
+// or not it ultimately succeeds. Implementations are called synchronously
+// from the goroutine driving the transition, never from inside a guard, so
+// a slow Observer can't starve guard evaluation but can slow down the
+// caller.
+type Observer interface {
+	OnAttempt(from, to State)
+	OnDenied(from, to State, err error)
+	OnCommitted(from, to State)
+}
+
+// WithObserver registers one or more Observers on a Machine.
+func WithObserver(observers ...Observer) Option {
+	return func(m *Machine) { m.Observers = append(m.Observers, observers...) }
+}
+
+// TransitionEvent records the outcome of a single transition attempt.
+type TransitionEvent struct {
+	From State
+	To   State
+	At   time.Time
+	Err  error
+}
+
+// HistoryRecorder is an Observer that keeps the last N transition attempts
+// in a ring buffer, retrievable with History.
+type HistoryRecorder struct {
+	mu     sync.Mutex
+	events []TransitionEvent
+	next   int
+	filled bool
+}
+
+// NewHistoryRecorder builds a HistoryRecorder that retains the last size
+// transitions.
+func NewHistoryRecorder(size int) *HistoryRecorder {
+	return &HistoryRecorder{events: make([]TransitionEvent, size)}
+}
+
+// OnAttempt implements Observer. HistoryRecorder only records the outcome
+// of a transition, so it does nothing here.
+func (h *HistoryRecorder) OnAttempt(from, to State) {}
+
+// OnDenied implements Observer.
+func (h *HistoryRecorder) OnDenied(from, to State, err error) {
+	h.record(from, to, err)
+}
+
+// OnCommitted implements Observer.
+func (h *HistoryRecorder) OnCommitted(from, to State) {
+	h.record(from, to, nil)
+}
+
+func (h *HistoryRecorder) record(from, to State, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.events) == 0 {
+		return
+	}
+
+	h.events[h.next] = TransitionEvent{From: from, To: to, At: time.Now(), Err: err}
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.filled = true
+	}
+}
+
+// History returns the recorded transitions, oldest first.
+func (h *HistoryRecorder) History() []TransitionEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.filled {
+		out := make([]TransitionEvent, h.next)
+		copy(out, h.events[:h.next])
+		return out
+	}
+
+	out := make([]TransitionEvent, len(h.events))
+	copy(out, h.events[h.next:])
+	copy(out[len(h.events)-h.next:], h.events[:h.next])
+	return out
+}
@@ -0,0 +1,88 @@
+package fsm
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrStaleState is returned by CommitTransition (and surfaces from
+// TransitionContext) when the (from, version) pair passed no longer matches
+// what the Store has on record -- i.e. another process already moved the
+// subject on.
+var ErrStaleState = errors.New("fsm: stale state")
+
+// Store persists the state of subjects identified by an id, so a Machine
+// can be reconstructed and continue where a previous process left off.
+//
+// Load and CommitTransition together form an optimistic-concurrency
+// contract: version is the number of transitions previously committed for
+// id, starting at 0 for a subject that has never transitioned. A
+// CommitTransition call must atomically verify that id's currently stored
+// state equals from and its stored version equals version, then store to
+// and increment the version -- otherwise it must return ErrStaleState
+// without changing anything. A SQL backend can implement this with
+// `UPDATE ... SET state = ?, version = version + 1 WHERE id = ? AND state =
+// ? AND version = ?` and treating zero rows affected as ErrStaleState; a KV
+// backend can use a compare-and-swap on a (state, version) value.
+type Store interface {
+	Load(id string) (State, uint64, error)
+	CommitTransition(id string, from, to State, version uint64) error
+}
+
+// WithStore sets the Store a Machine persists to, and the id it persists
+// under. If a Subject is also set, the Subject's state is replaced with
+// whatever Store.Load(id) returns immediately, at construction; see New.
+func WithStore(store Store, id string) Option {
+	return func(m *Machine) {
+		m.Store = store
+		m.StoreID = id
+	}
+}
+
+// MemoryStore is an in-memory Store, useful for tests.
+type MemoryStore struct {
+	mu       sync.Mutex
+	states   map[string]State
+	versions map[string]uint64
+}
+
+// NewMemoryStore builds an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		states:   make(map[string]State),
+		versions: make(map[string]uint64),
+	}
+}
+
+// Seed sets id's initial state and resets its version to 0, as if it had
+// never transitioned.
+func (s *MemoryStore) Seed(id string, state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[id] = state
+	s.versions[id] = 0
+}
+
+// Load implements Store.
+func (s *MemoryStore) Load(id string) (State, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.states[id], s.versions[id], nil
+}
+
+// CommitTransition implements Store.
+func (s *MemoryStore) CommitTransition(id string, from, to State, version uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.states[id] != from || s.versions[id] != version {
+		return ErrStaleState
+	}
+
+	s.states[id] = to
+	s.versions[id] = version + 1
+
+	return nil
+}